@@ -83,11 +83,7 @@ func (w *tcpWorker) callback(conn stat.Connection) {
 	ctx = session.ContextWithOutbounds(ctx, outbounds)
 
 	if w.uplinkCounter != nil || w.downlinkCounter != nil {
-		conn = &stat.CounterConnection{
-			Connection:   conn,
-			ReadCounter:  w.uplinkCounter,
-			WriteCounter: w.downlinkCounter,
-		}
+		conn = stat.NewDirectionalCounter(conn, w.uplinkCounter, w.downlinkCounter, true)
 	}
 	ctx = session.ContextWithInbound(ctx, &session.Inbound{
 		Source:  net.DestinationFromAddr(conn.RemoteAddr()),
@@ -458,11 +454,7 @@ func (w *dsWorker) callback(conn stat.Connection) {
 	ctx = c.ContextWithID(ctx, sid)
 
 	if w.uplinkCounter != nil || w.downlinkCounter != nil {
-		conn = &stat.CounterConnection{
-			Connection:   conn,
-			ReadCounter:  w.uplinkCounter,
-			WriteCounter: w.downlinkCounter,
-		}
+		conn = stat.NewDirectionalCounter(conn, w.uplinkCounter, w.downlinkCounter, true)
 	}
 	ctx = session.ContextWithInbound(ctx, &session.Inbound{
 		Source:  net.DestinationFromAddr(conn.RemoteAddr()),
@@ -80,9 +80,9 @@ func NewReader(reader io.Reader) Reader {
 			} else {
 				var counter stats.Counter
 
-				if statConn, ok := reader.(*stat.CounterConnection); ok {
+				if statConn, ok := reader.(*stat.CounterConnection); ok && statConn.PlainRead() {
 					reader = statConn.Connection
-					counter = statConn.ReadCounter
+					counter = statConn.PlainReadCounter()
 				}
 				return NewReadVReader(reader, rawConn, counter)
 			}
@@ -124,8 +124,10 @@ func NewWriter(writer io.Writer) Writer {
 	}
 
 	iConn := writer
-	if statConn, ok := writer.(*stat.CounterConnection); ok {
+	var counter stats.Counter
+	if statConn, ok := writer.(*stat.CounterConnection); ok && statConn.PlainWrite() {
 		iConn = statConn.Connection
+		counter = statConn.PlainWriteCounter()
 	}
 
 	if isPacketWriter(iConn) {
@@ -134,11 +136,6 @@ func NewWriter(writer io.Writer) Writer {
 		}
 	}
 
-	var counter stats.Counter
-
-	if statConn, ok := writer.(*stat.CounterConnection); ok {
-		counter = statConn.WriteCounter
-	}
 	return &BufferToBytesWriter{
 		Writer:  iConn,
 		counter: counter,
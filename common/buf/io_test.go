@@ -3,11 +3,18 @@ package buf_test
 import (
 	"crypto/tls"
 	"io"
+	"math"
 	"testing"
+	"time"
 
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
 	. "github.com/xtls/xray-core/common/buf"
 	"github.com/xtls/xray-core/common/net"
+	feature_stats "github.com/xtls/xray-core/features/stats"
 	"github.com/xtls/xray-core/testing/servers/tcp"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"golang.org/x/time/rate"
 )
 
 func TestWriterCreation(t *testing.T) {
@@ -48,3 +55,183 @@ func TestWriterCreation(t *testing.T) {
 		}
 	}
 }
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	common.Must(err)
+	server, err := listener.Accept()
+	common.Must(err)
+	return client, server
+}
+
+func TestWriterStatConnection(t *testing.T) {
+	conn, peer := tcpPair()
+	defer conn.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	shared := new(stats.Counter)
+	shared.Add(100)
+	plain := &stat.CounterConnection{
+		Connection:   conn,
+		WriteCounter: shared,
+	}
+	writer := NewWriter(plain)
+	if _, ok := writer.(*BufferToBytesWriter); !ok {
+		t.Error("writer of a plain stat conn is not a BufferToBytesWriter")
+	}
+	pb := New()
+	pb.Extend(10)
+	common.Must(writer.WriteMultiBuffer(MultiBuffer{pb}))
+	if v := plain.WriteBytes(); v != 10 {
+		t.Error("unexpected WriteBytes() return: ", v, ", wanted ", 10)
+	}
+	if v := shared.Value(); v != 110 {
+		t.Error("unexpected shared counter value: ", v, ", wanted ", 110)
+	}
+
+	limited := &stat.CounterConnection{
+		Connection:   conn,
+		WriteCounter: new(stats.Counter),
+		WriteLimiter: rate.NewLimiter(16*1024, 1024),
+	}
+	b := New()
+	b.Extend(8000)
+
+	start := time.Now()
+	common.Must(NewWriter(limited).WriteMultiBuffer(MultiBuffer{b}))
+	// The first 1KiB is covered by the initial burst.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Error("rate limit bypassed: 8000 bytes at 16KiB/s took ", elapsed)
+	}
+	if v := limited.WriteBytes(); v != 8000 {
+		t.Error("unexpected WriteBytes() return: ", v, ", wanted ", 8000)
+	}
+}
+
+func TestStatConnectionCallCounters(t *testing.T) {
+	conn, peer := tcpPair()
+	defer conn.Close()
+	defer peer.Close()
+
+	statConn := &stat.CounterConnection{
+		Connection:       conn,
+		ReadCallCounter:  new(stats.Counter),
+		WriteCallCounter: new(stats.Counter),
+	}
+
+	b := New()
+	b.WriteString("hello")
+	common.Must(NewWriter(statConn).WriteMultiBuffer(MultiBuffer{b}))
+	common.Must2(peer.Write([]byte("world")))
+
+	mb, err := NewReader(statConn).ReadMultiBuffer()
+	common.Must(err)
+	ReleaseMulti(mb)
+
+	if v := statConn.WriteCallCounter.Value(); v != 1 {
+		t.Error("unexpected write calls: ", v, ", wanted ", 1)
+	}
+	if v := statConn.ReadCallCounter.Value(); v != 1 {
+		t.Error("unexpected read calls: ", v, ", wanted ", 1)
+	}
+}
+
+func TestStatConnectionFirstByteHooks(t *testing.T) {
+	conn, peer := tcpPair()
+	defer conn.Close()
+	defer peer.Close()
+
+	var reads, writes int
+	statConn := &stat.CounterConnection{
+		Connection:   conn,
+		OnFirstRead:  func() { reads++ },
+		OnFirstWrite: func() { writes++ },
+	}
+
+	writer := NewWriter(statConn)
+	reader := NewReader(statConn)
+	for i := 0; i < 2; i++ {
+		b := New()
+		b.WriteString("ping")
+		common.Must(writer.WriteMultiBuffer(MultiBuffer{b}))
+		common.Must2(io.ReadFull(peer, make([]byte, 4)))
+		common.Must2(peer.Write([]byte("pong")))
+
+		mb, err := reader.ReadMultiBuffer()
+		common.Must(err)
+		ReleaseMulti(mb)
+	}
+
+	if reads != 1 || writes != 1 {
+		t.Error("unexpected hook calls: ", reads, " reads, ", writes, " writes, wanted 1 each")
+	}
+}
+
+func TestStatConnectionReadIdleTimeout(t *testing.T) {
+	conn, peer := tcpPair()
+	defer conn.Close()
+	defer peer.Close()
+
+	statConn := &stat.CounterConnection{
+		Connection:      conn,
+		ReadIdleTimeout: 50 * time.Millisecond,
+	}
+
+	_, err := NewReader(statConn).ReadMultiBuffer()
+	if err == nil || !err.(net.Error).Timeout() {
+		t.Error("expected idle timeout from a silent peer, got ", err)
+	}
+}
+
+func TestStatConnectionOnIdle(t *testing.T) {
+	conn, peer := tcpPair()
+	defer conn.Close()
+	defer peer.Close()
+
+	idle := make(chan struct{}, 1)
+	statConn := &stat.CounterConnection{
+		Connection: conn,
+		OnIdle:     func() { idle <- struct{}{} },
+		IdleWindow: 50 * time.Millisecond,
+	}
+
+	go func() {
+		mb, _ := NewReader(statConn).ReadMultiBuffer()
+		ReleaseMulti(mb)
+	}()
+
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Error("OnIdle did not fire for a reader created by NewReader")
+	}
+	common.Must(statConn.Close())
+}
+
+func TestStatConnectionCounterWrap(t *testing.T) {
+	conn, peer := tcpPair()
+	defer conn.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	wrapped := false
+	statConn := &stat.CounterConnection{
+		Connection:    conn,
+		WriteCounter:  new(stats.Counter),
+		OnCounterWrap: func(feature_stats.Counter) { wrapped = true },
+	}
+	statConn.WriteCounter.Set(math.MaxInt64 - 2)
+
+	b := New()
+	b.Extend(8)
+	common.Must(NewWriter(statConn).WriteMultiBuffer(MultiBuffer{b}))
+	if !wrapped {
+		t.Error("OnCounterWrap did not fire for a writer created by NewWriter")
+	}
+}
@@ -17,7 +17,7 @@ type Counter interface {
 	Value() int64
 	// Set sets a new value to the counter, and returns the previous one.
 	Set(int64) int64
-	// Add adds a value to the current counter value, and returns the previous value.
+	// Add adds a value to the current counter value, and returns the new value.
 	Add(int64) int64
 }
 
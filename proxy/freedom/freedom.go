@@ -273,15 +273,18 @@ func isTLSConn(conn stat.Connection) bool {
 	return false
 }
 
+// NewPacketReader reads the raw packet conn directly only if the stat conn, if
+// any, has no per-call read feature. Otherwise packets go through the stat conn
+// and lose their source address.
 func NewPacketReader(conn net.Conn, UDPOverride net.Destination) buf.Reader {
 	iConn := conn
-	statConn, ok := iConn.(*stat.CounterConnection)
-	if ok {
-		iConn = statConn.Connection
-	}
 	var counter stats.Counter
-	if statConn != nil {
-		counter = statConn.ReadCounter
+	if statConn, ok := iConn.(*stat.CounterConnection); ok {
+		if !statConn.PlainRead() {
+			return &buf.PacketReader{Reader: conn}
+		}
+		iConn = statConn.Connection
+		counter = statConn.PlainReadCounter()
 	}
 	if c, ok := iConn.(*internet.PacketConnWrapper); ok && UDPOverride.Address == nil && UDPOverride.Port == 0 {
 		return &PacketReader{
@@ -317,15 +320,18 @@ func (r *PacketReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
 	return buf.MultiBuffer{b}, nil
 }
 
+// NewPacketWriter writes the raw packet conn directly only if the stat conn, if
+// any, has no per-call write feature. Otherwise packets go through the stat
+// conn and are all sent to its remote address.
 func NewPacketWriter(conn net.Conn, h *Handler, ctx context.Context, UDPOverride net.Destination) buf.Writer {
 	iConn := conn
-	statConn, ok := iConn.(*stat.CounterConnection)
-	if ok {
-		iConn = statConn.Connection
-	}
 	var counter stats.Counter
-	if statConn != nil {
-		counter = statConn.WriteCounter
+	if statConn, ok := iConn.(*stat.CounterConnection); ok {
+		if !statConn.PlainWrite() {
+			return &buf.SequentialWriter{Writer: conn}
+		}
+		iConn = statConn.Connection
+		counter = statConn.PlainWriteCounter()
 	}
 	if c, ok := iConn.(*internet.PacketConnWrapper); ok {
 		return &PacketWriter{
@@ -0,0 +1,94 @@
+package freedom_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	. "github.com/xtls/xray-core/proxy/freedom"
+	"github.com/xtls/xray-core/transport/internet"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"golang.org/x/time/rate"
+)
+
+func udpPair() (*internet.PacketConnWrapper, *net.UDPConn) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	common.Must(err)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	common.Must(err)
+	return &internet.PacketConnWrapper{Conn: conn, Dest: peer.LocalAddr()}, peer
+}
+
+func TestPacketReaderStatConnection(t *testing.T) {
+	conn, peer := udpPair()
+	defer conn.Close()
+	defer peer.Close()
+
+	plain := &stat.CounterConnection{
+		Connection:  conn,
+		ReadCounter: new(stats.Counter),
+	}
+	if _, ok := NewPacketReader(plain, net.Destination{}).(*PacketReader); !ok {
+		t.Error("reader of a plain stat conn is not a PacketReader")
+	}
+
+	var reads int
+	hooked := &stat.CounterConnection{
+		Connection:  conn,
+		ReadCounter: new(stats.Counter),
+		OnFirstRead: func() { reads++ },
+	}
+	reader := NewPacketReader(hooked, net.Destination{})
+	common.Must2(peer.WriteTo(make([]byte, 10), conn.Conn.LocalAddr()))
+	mb, err := reader.ReadMultiBuffer()
+	common.Must(err)
+	buf.ReleaseMulti(mb)
+
+	if reads != 1 {
+		t.Error("OnFirstRead bypassed by the packet reader")
+	}
+	if v := hooked.ReadBytes(); v != 10 {
+		t.Error("unexpected ReadBytes() return: ", v, ", wanted ", 10)
+	}
+}
+
+func TestPacketWriterStatConnection(t *testing.T) {
+	conn, peer := udpPair()
+	defer conn.Close()
+	defer peer.Close()
+
+	plain := &stat.CounterConnection{
+		Connection:   conn,
+		WriteCounter: new(stats.Counter),
+	}
+	if _, ok := NewPacketWriter(plain, nil, context.Background(), net.Destination{}).(*PacketWriter); !ok {
+		t.Error("writer of a plain stat conn is not a PacketWriter")
+	}
+
+	limited := &stat.CounterConnection{
+		Connection:   conn,
+		WriteCounter: new(stats.Counter),
+		WriteLimiter: rate.NewLimiter(4000, 1000),
+	}
+	writer := NewPacketWriter(limited, nil, context.Background(), net.Destination{})
+	var mb buf.MultiBuffer
+	for i := 0; i < 3; i++ {
+		b := buf.New()
+		b.Extend(1000)
+		mb = append(mb, b)
+	}
+
+	start := time.Now()
+	common.Must(writer.WriteMultiBuffer(mb))
+	// The first packet is covered by the initial burst.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("rate limit bypassed: 3000 bytes at 4000B/s took ", elapsed)
+	}
+	if v := limited.WriteBytes(); v != 3000 {
+		t.Error("unexpected WriteBytes() return: ", v, ", wanted ", 3000)
+	}
+}
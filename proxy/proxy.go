@@ -525,14 +525,16 @@ func XtlsFilterTls(buffer buf.MultiBuffer, trafficState *TrafficState, ctx conte
 }
 
 // UnwrapRawConn support unwrap stats, tls, utls, reality, proxyproto, uds-wrapper conn and get raw tcp/uds conn from it
+// If the stats conn has per-call features (limiters, hooks), the raw conn is rebound to it and no counters are returned.
 func UnwrapRawConn(conn net.Conn) (net.Conn, stats.Counter, stats.Counter) {
 	var readCounter, writerCounter stats.Counter
+	var statConn *stat.CounterConnection
 	if conn != nil {
-		statConn, ok := conn.(*stat.CounterConnection)
-		if ok {
-			conn = statConn.Connection
-			readCounter = statConn.ReadCounter
-			writerCounter = statConn.WriteCounter
+		if sc, ok := conn.(*stat.CounterConnection); ok {
+			statConn = sc
+			conn = sc.Connection
+			readCounter = sc.PlainReadCounter()
+			writerCounter = sc.PlainWriteCounter()
 		}
 		if xc, ok := conn.(*tls.Conn); ok {
 			conn = xc.NetConn()
@@ -550,6 +552,9 @@ func UnwrapRawConn(conn net.Conn) (net.Conn, stats.Counter, stats.Counter) {
 		if uc, ok := conn.(*internet.UnixConnWrapper); ok {
 			conn = uc.UnixConn
 		}
+		if statConn != nil && (!statConn.PlainRead() || !statConn.PlainWrite()) {
+			return statConn.Rebind(conn), nil, nil
+		}
 	}
 	return conn, readCounter, writerCounter
 }
@@ -1,9 +1,17 @@
 package stat
 
 import (
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/xtls/xray-core/common/errors"
+	"github.com/xtls/xray-core/common/signal/done"
+	"github.com/xtls/xray-core/features/policy"
 	"github.com/xtls/xray-core/features/stats"
+	"golang.org/x/time/rate"
 )
 
 type Connection interface {
@@ -14,21 +22,446 @@ type CounterConnection struct {
 	Connection
 	ReadCounter  stats.Counter
 	WriteCounter stats.Counter
+	// ReadCallCounter and WriteCallCounter, if set, are incremented once per
+	// Read and Write call respectively, regardless of the number of bytes.
+	ReadCallCounter  stats.Counter
+	WriteCallCounter stats.Counter
+	// OnFirstRead and OnFirstWrite, if set, are called once after the first
+	// Read or Write that transfers at least one byte.
+	OnFirstRead  func()
+	OnFirstWrite func()
+	// ReadLimiter and WriteLimiter, if set, cap the throughput of Read and
+	// Write. Reads are throttled after the transfer, writes before it.
+	ReadLimiter  *rate.Limiter
+	WriteLimiter *rate.Limiter
+	// ReadIdleTimeout, if positive, sets the read deadline to this duration
+	// from now at the start of every Read, so a peer that sends nothing for
+	// that long times the Read out. A non-zero deadline set by the caller via
+	// SetReadDeadline or SetDeadline takes precedence until it is cleared with
+	// a zero time, which re-arms the idle deadline.
+	// It relies on SetReadDeadline of the underlying connection: TCP, TLS,
+	// REALITY, WebSocket, HTTPUpgrade and Unix connections honor it, while it
+	// is a no-op on SplitHTTP, gRPC and other cnc-based connections. If the
+	// deadline cannot be set, as on a KCP connection that is closing, the Read
+	// still runs; its own error takes precedence over the deadline error.
+	ReadIdleTimeout time.Duration
+	// OnCounterWrap, if set, is called with ReadCounter or WriteCounter when
+	// adding to it overflows int64. The counter then continues from
+	// math.MinInt64, so a monitor should treat a negative delta as a wrap.
+	OnCounterWrap func(stats.Counter)
+	// OnIdle, if set together with a positive IdleWindow, is called once when
+	// no Read has returned data for IdleWindow, counted from the first Read.
+	// It fires again only after new data arrives, and never after Close.
+	OnIdle     func()
+	IdleWindow time.Duration
+
+	firstRead  sync.Once
+	firstWrite sync.Once
+	doneOnce   sync.Once
+	done       *done.Instance
+	idleOnce   sync.Once
+	idleTimer  *time.Timer
+
+	deadlineAccess sync.Mutex
+	callerDeadline bool
+
+	// readBytes and writeBytes count the bytes of this connection alone, as
+	// ReadCounter and WriteCounter are usually shared by every connection of
+	// an inbound or outbound tag.
+	readBytes  atomic.Int64
+	writeBytes atomic.Int64
+	// readSampled and writeSampled hold the totals at the last SwapAndReset.
+	readSampled  atomic.Int64
+	writeSampled atomic.Int64
+}
+
+// NewDirectionalCounter wraps conn so that uplink counts traffic from the client
+// and downlink counts traffic to the client. For an inbound connection the
+// client is the remote peer, so reads are uplink; for an outbound connection
+// it is the local side, so writes are uplink.
+func NewDirectionalCounter(conn Connection, uplink, downlink stats.Counter, isInbound bool) *CounterConnection {
+	if isInbound {
+		return &CounterConnection{
+			Connection:   conn,
+			ReadCounter:  uplink,
+			WriteCounter: downlink,
+		}
+	}
+	return &CounterConnection{
+		Connection:   conn,
+		ReadCounter:  downlink,
+		WriteCounter: uplink,
+	}
+}
+
+// TrafficCounters returns the uplink and downlink traffic counters of an
+// inbound or outbound tag, registering them in manager when needed. A direction
+// is only resolved if it is enabled in policy; otherwise, or if manager is nil
+// or tag is empty, its counter is nil.
+func TrafficCounters(manager stats.Manager, policy policy.SystemStats, tag string, isInbound bool) (uplink, downlink stats.Counter) {
+	if manager == nil || len(tag) == 0 {
+		return nil, nil
+	}
+	prefix := "outbound>>>" + tag
+	enableUplink, enableDownlink := policy.OutboundUplink, policy.OutboundDownlink
+	if isInbound {
+		prefix = "inbound>>>" + tag
+		enableUplink, enableDownlink = policy.InboundUplink, policy.InboundDownlink
+	}
+	if enableUplink {
+		uplink, _ = stats.GetOrRegisterCounter(manager, prefix+">>>traffic>>>uplink")
+	}
+	if enableDownlink {
+		downlink, _ = stats.GetOrRegisterCounter(manager, prefix+">>>traffic>>>downlink")
+	}
+	return
 }
 
 func (c *CounterConnection) Read(b []byte) (int, error) {
-	nBytes, err := c.Connection.Read(b)
-	if c.ReadCounter != nil {
-		c.ReadCounter.Add(int64(nBytes))
+	return c.read(c.Connection, b)
+}
+
+func (c *CounterConnection) Write(b []byte) (int, error) {
+	return c.write(c.Connection, b)
+}
+
+func (c *CounterConnection) read(conn net.Conn, b []byte) (int, error) {
+	if c.ReadLimiter != nil {
+		if burst := c.ReadLimiter.Burst(); burst > 0 && len(b) > burst {
+			b = b[:burst]
+		}
+	}
+	if c.idleWatch() {
+		c.idleOnce.Do(c.startIdleTimer)
+	}
+	var deadlineErr error
+	if c.ReadIdleTimeout > 0 {
+		deadlineErr = c.armReadDeadline(conn)
+	}
+	nBytes, err := conn.Read(b)
+	if err == nil {
+		err = deadlineErr
+	}
+	if c.ReadLimiter != nil && nBytes > 0 && err == nil {
+		err = c.wait(c.ReadLimiter, nBytes)
+	}
+	// idleTimer stays nil if Close ran before the first Read.
+	if c.idleWatch() && nBytes > 0 && c.idleTimer != nil {
+		c.idleTimer.Reset(c.IdleWindow)
+	}
+	c.count(&c.readBytes, c.ReadCounter, int64(nBytes))
+	if c.ReadCallCounter != nil {
+		c.ReadCallCounter.Add(1)
+	}
+	if c.OnFirstRead != nil && nBytes > 0 {
+		c.firstRead.Do(c.OnFirstRead)
 	}
 
 	return nBytes, err
 }
 
-func (c *CounterConnection) Write(b []byte) (int, error) {
-	nBytes, err := c.Connection.Write(b)
-	if c.WriteCounter != nil {
-		c.WriteCounter.Add(int64(nBytes))
+func (c *CounterConnection) write(conn net.Conn, b []byte) (int, error) {
+	var nBytes int
+	var err error
+	if c.WriteLimiter != nil {
+		nBytes, err = c.limitedWrite(conn, b)
+	} else {
+		nBytes, err = conn.Write(b)
+	}
+	c.count(&c.writeBytes, c.WriteCounter, int64(nBytes))
+	if c.WriteCallCounter != nil {
+		c.WriteCallCounter.Add(1)
+	}
+	if c.OnFirstWrite != nil && nBytes > 0 {
+		c.firstWrite.Do(c.OnFirstWrite)
 	}
 	return nBytes, err
 }
+
+// SetDeadline implements net.Conn.
+func (c *CounterConnection) SetDeadline(t time.Time) error {
+	return c.setDeadline(c.Connection, t)
+}
+
+// SetReadDeadline implements net.Conn. See ReadIdleTimeout for how t interacts
+// with the idle deadline.
+func (c *CounterConnection) SetReadDeadline(t time.Time) error {
+	return c.setReadDeadline(c.Connection, t)
+}
+
+func (c *CounterConnection) setDeadline(conn net.Conn, t time.Time) error {
+	if c.ReadIdleTimeout <= 0 {
+		return conn.SetDeadline(t)
+	}
+	if err := c.setReadDeadline(conn, t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+func (c *CounterConnection) setReadDeadline(conn net.Conn, t time.Time) error {
+	if c.ReadIdleTimeout <= 0 {
+		return conn.SetReadDeadline(t)
+	}
+	c.deadlineAccess.Lock()
+	defer c.deadlineAccess.Unlock()
+	c.callerDeadline = !t.IsZero()
+	if t.IsZero() {
+		t = time.Now().Add(c.ReadIdleTimeout)
+	}
+	return conn.SetReadDeadline(t)
+}
+
+func (c *CounterConnection) armReadDeadline(conn net.Conn) error {
+	c.deadlineAccess.Lock()
+	defer c.deadlineAccess.Unlock()
+	if c.callerDeadline {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(c.ReadIdleTimeout))
+}
+
+// ReadFrom implements io.ReaderFrom. It delegates to the underlying connection
+// when it has a fast path and no per-call write feature is enabled. On that
+// path WriteCounter and WriteBytes are only updated once the whole copy
+// returns, so a long-lived copy shows no traffic in the stats until it ends.
+func (c *CounterConnection) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := c.Connection.(io.ReaderFrom)
+	if !ok || !c.PlainWrite() {
+		return io.Copy(writerOnly{c}, r)
+	}
+	n, err := rf.ReadFrom(r)
+	c.count(&c.writeBytes, c.WriteCounter, n)
+	return n, err
+}
+
+// WriteTo implements io.WriterTo. It delegates to the underlying connection
+// when it has a fast path and no per-call read feature is enabled. As with
+// ReadFrom, ReadCounter and ReadBytes are then only updated once the whole copy
+// returns.
+func (c *CounterConnection) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := c.Connection.(io.WriterTo)
+	if !ok || !c.PlainRead() {
+		return io.Copy(w, readerOnly{c})
+	}
+	n, err := wt.WriteTo(w)
+	c.count(&c.readBytes, c.ReadCounter, n)
+	return n, err
+}
+
+// count adds n to total and, if set, to counter. stats.Counter.Add returns the
+// new value, so an overflow shows up as a result smaller than the value before
+// the Add.
+func (c *CounterConnection) count(total *atomic.Int64, counter stats.Counter, n int64) {
+	total.Add(n)
+	if counter == nil {
+		return
+	}
+	v := counter.Add(n)
+	if c.OnCounterWrap != nil && n > 0 && v-n > v {
+		c.OnCounterWrap(counter)
+	}
+}
+
+// PlainRead reports whether Read only counts bytes. Only then may callers read
+// c.Connection directly and add the bytes to PlainReadCounter themselves.
+func (c *CounterConnection) PlainRead() bool {
+	return c.ReadCallCounter == nil && c.OnFirstRead == nil && c.ReadLimiter == nil && c.ReadIdleTimeout == 0 && !c.idleWatch() && c.OnCounterWrap == nil
+}
+
+// PlainWrite reports whether Write only counts bytes. Only then may callers
+// write c.Connection directly and add the bytes to PlainWriteCounter
+// themselves.
+func (c *CounterConnection) PlainWrite() bool {
+	return c.WriteCallCounter == nil && c.OnFirstWrite == nil && c.WriteLimiter == nil && c.OnCounterWrap == nil
+}
+
+// PlainReadCounter returns the counter for bytes read from c.Connection without
+// going through Read. It adds to ReadCounter, if set, and to the total reported
+// by ReadBytes.
+func (c *CounterConnection) PlainReadCounter() stats.Counter {
+	return &plainCounter{total: &c.readBytes, counter: c.ReadCounter}
+}
+
+// PlainWriteCounter is the write-side equivalent of PlainReadCounter.
+func (c *CounterConnection) PlainWriteCounter() stats.Counter {
+	return &plainCounter{total: &c.writeBytes, counter: c.WriteCounter}
+}
+
+// Rebind returns a connection that reads and writes conn, typically the raw
+// connection under c.Connection, while still going through c's counters,
+// limiters and hooks. It is used where a proxy bypasses intermediate layers
+// such as TLS.
+func (c *CounterConnection) Rebind(conn net.Conn) Connection {
+	return &boundConnection{Conn: conn, parent: c}
+}
+
+// ReadBytes returns the number of bytes read from this connection. Unlike
+// ReadCounter, which may be shared with other connections, it only covers c.
+func (c *CounterConnection) ReadBytes() int64 {
+	return c.readBytes.Load()
+}
+
+// WriteBytes returns the number of bytes written to this connection. Unlike
+// WriteCounter, which may be shared with other connections, it only covers c.
+func (c *CounterConnection) WriteBytes() int64 {
+	return c.writeBytes.Load()
+}
+
+// SwapAndReset returns the bytes read and written on this connection since the
+// previous call, or since it was created. It never resets ReadCounter or
+// WriteCounter, which are usually shared by all connections of a tag and back
+// the global stats; ReadBytes and WriteBytes keep reporting the full totals.
+// Each direction is sampled atomically on its own, so bytes transferred
+// between the two samples are reported in the next interval for one direction
+// and in this one for the other. No byte is lost or counted twice.
+func (c *CounterConnection) SwapAndReset() (read, write int64) {
+	return sample(&c.readBytes, &c.readSampled), sample(&c.writeBytes, &c.writeSampled)
+}
+
+// sample returns the growth of total since the value recorded in sampled and
+// records the current value.
+func sample(total, sampled *atomic.Int64) int64 {
+	for {
+		prev := sampled.Load()
+		cur := total.Load()
+		if sampled.CompareAndSwap(prev, cur) {
+			return cur - prev
+		}
+	}
+}
+
+func (c *CounterConnection) Close() error {
+	return c.close(c.Connection)
+}
+
+func (c *CounterConnection) close(conn net.Conn) error {
+	if c.ReadLimiter != nil || c.WriteLimiter != nil || c.idleWatch() {
+		c.closed().Close()
+	}
+	if c.idleWatch() {
+		// Synchronizes with startIdleTimer in a concurrent Read.
+		c.idleOnce.Do(func() {})
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+	}
+	return conn.Close()
+}
+
+func (c *CounterConnection) closed() *done.Instance {
+	c.doneOnce.Do(func() {
+		c.done = done.New()
+	})
+	return c.done
+}
+
+func (c *CounterConnection) idleWatch() bool {
+	return c.OnIdle != nil && c.IdleWindow > 0
+}
+
+func (c *CounterConnection) startIdleTimer() {
+	c.idleTimer = time.AfterFunc(c.IdleWindow, func() {
+		if !c.closed().Done() {
+			c.OnIdle()
+		}
+	})
+}
+
+func (c *CounterConnection) limitedWrite(conn net.Conn, b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if burst := c.WriteLimiter.Burst(); burst > 0 && len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err := c.wait(c.WriteLimiter, len(chunk)); err != nil {
+			return n, err
+		}
+		nw, err := conn.Write(chunk)
+		n += nw
+		if err != nil {
+			return n, err
+		}
+		b = b[nw:]
+	}
+	return n, nil
+}
+
+// wait blocks until the limiter allows n bytes, or until the connection is closed.
+func (c *CounterConnection) wait(limiter *rate.Limiter, n int) error {
+	r := limiter.ReserveN(time.Now(), n)
+	if !r.OK() {
+		return errors.New("rate limiter burst is too small for ", n, " bytes")
+	}
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.closed().Wait():
+		r.Cancel()
+		return net.ErrClosed
+	}
+}
+
+// writerOnly and readerOnly hide ReadFrom/WriteTo so that io.Copy falls back
+// to the Read/Write methods instead of recursing.
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+// plainCounter adds to a per-connection total and an optional shared counter.
+// Value and Set only concern the total.
+type plainCounter struct {
+	total   *atomic.Int64
+	counter stats.Counter
+}
+
+func (c *plainCounter) Value() int64 {
+	return c.total.Load()
+}
+
+func (c *plainCounter) Set(v int64) int64 {
+	return c.total.Swap(v)
+}
+
+func (c *plainCounter) Add(n int64) int64 {
+	if c.counter != nil {
+		c.counter.Add(n)
+	}
+	return c.total.Add(n)
+}
+
+type boundConnection struct {
+	net.Conn
+	parent *CounterConnection
+}
+
+func (c *boundConnection) Read(b []byte) (int, error) {
+	return c.parent.read(c.Conn, b)
+}
+
+func (c *boundConnection) Write(b []byte) (int, error) {
+	return c.parent.write(c.Conn, b)
+}
+
+func (c *boundConnection) SetDeadline(t time.Time) error {
+	return c.parent.setDeadline(c.Conn, t)
+}
+
+func (c *boundConnection) SetReadDeadline(t time.Time) error {
+	return c.parent.setReadDeadline(c.Conn, t)
+}
+
+func (c *boundConnection) Close() error {
+	return c.parent.close(c.Conn)
+}
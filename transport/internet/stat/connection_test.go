@@ -0,0 +1,583 @@
+package stat_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/features/policy"
+	feature_stats "github.com/xtls/xray-core/features/stats"
+	. "github.com/xtls/xray-core/transport/internet/stat"
+	"golang.org/x/time/rate"
+)
+
+func TestCounterConnectionBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:   server,
+		ReadCounter:  new(stats.Counter),
+		WriteCounter: new(stats.Counter),
+	}
+	defer conn.Close()
+
+	go func() {
+		common.Must2(client.Write([]byte("hello")))
+		common.Must2(io.ReadFull(client, make([]byte, 3)))
+	}()
+
+	common.Must2(io.ReadFull(conn, make([]byte, 5)))
+	common.Must2(conn.Write([]byte("abc")))
+
+	if v := conn.ReadBytes(); v != 5 {
+		t.Error("unexpected ReadBytes() return: ", v, ", wanted ", 5)
+	}
+	if v := conn.WriteBytes(); v != 3 {
+		t.Error("unexpected WriteBytes() return: ", v, ", wanted ", 3)
+	}
+
+	empty := &CounterConnection{Connection: server}
+	if empty.ReadBytes() != 0 || empty.WriteBytes() != 0 {
+		t.Error("expected 0 bytes without counters")
+	}
+}
+
+func TestCounterConnectionBytesSharedCounter(t *testing.T) {
+	uplink := new(stats.Counter)
+	downlink := new(stats.Counter)
+
+	var conns []*CounterConnection
+	for _, size := range []int{3, 5} {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		conn := NewDirectionalCounter(server, uplink, downlink, true)
+		defer conn.Close()
+		conns = append(conns, conn)
+
+		go func() {
+			common.Must2(client.Write(make([]byte, size)))
+			common.Must2(io.ReadFull(client, make([]byte, 2*size)))
+		}()
+		common.Must2(io.ReadFull(conn, make([]byte, size)))
+		common.Must2(conn.Write(make([]byte, 2*size)))
+	}
+
+	if r, w := conns[0].ReadBytes(), conns[0].WriteBytes(); r != 3 || w != 6 {
+		t.Error("unexpected bytes of first connection: ", r, w, ", wanted ", 3, 6)
+	}
+	if r, w := conns[1].ReadBytes(), conns[1].WriteBytes(); r != 5 || w != 10 {
+		t.Error("unexpected bytes of second connection: ", r, w, ", wanted ", 5, 10)
+	}
+	if u, d := uplink.Value(), downlink.Value(); u != 8 || d != 16 {
+		t.Error("unexpected shared counters: ", u, d, ", wanted ", 8, 16)
+	}
+}
+
+func TestCounterConnectionCalls(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:       server,
+		ReadCallCounter:  new(stats.Counter),
+		WriteCallCounter: new(stats.Counter),
+	}
+	defer conn.Close()
+
+	go func() {
+		common.Must2(client.Write([]byte("ab")))
+		common.Must2(client.Write([]byte("cd")))
+		common.Must2(io.ReadFull(client, make([]byte, 4)))
+	}()
+
+	common.Must2(io.ReadFull(conn, make([]byte, 4)))
+	common.Must2(conn.Write([]byte("abcd")))
+
+	if v := conn.ReadCallCounter.Value(); v != 2 {
+		t.Error("unexpected read calls: ", v, ", wanted ", 2)
+	}
+	if v := conn.WriteCallCounter.Value(); v != 1 {
+		t.Error("unexpected write calls: ", v, ", wanted ", 1)
+	}
+}
+
+func TestCounterConnectionFirstByte(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var reads, writes int
+	conn := &CounterConnection{
+		Connection:   server,
+		OnFirstRead:  func() { reads++ },
+		OnFirstWrite: func() { writes++ },
+	}
+	defer conn.Close()
+
+	go func() {
+		common.Must2(client.Write([]byte("ab")))
+		common.Must2(client.Write([]byte("cd")))
+		common.Must2(io.ReadFull(client, make([]byte, 4)))
+	}()
+
+	common.Must2(conn.Read(nil))
+	if reads != 0 {
+		t.Error("OnFirstRead fired on a zero-byte read")
+	}
+	common.Must2(io.ReadFull(conn, make([]byte, 4)))
+	common.Must2(conn.Write([]byte("ab")))
+	common.Must2(conn.Write([]byte("cd")))
+
+	if reads != 1 || writes != 1 {
+		t.Error("unexpected hook calls: ", reads, " reads, ", writes, " writes, wanted 1 each")
+	}
+}
+
+func TestCounterConnectionWriteLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:   server,
+		WriteLimiter: rate.NewLimiter(100*1024, 10*1024),
+	}
+	defer conn.Close()
+
+	go io.Copy(io.Discard, client)
+
+	start := time.Now()
+	common.Must2(conn.Write(make([]byte, 60*1024)))
+	elapsed := time.Since(start)
+
+	// The first 10KiB are covered by the initial burst.
+	if elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Error("unexpected duration for 60KiB at 100KiB/s: ", elapsed)
+	}
+}
+
+func TestCounterConnectionLimitClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:   server,
+		WriteLimiter: rate.NewLimiter(1, 1),
+	}
+
+	go io.Copy(io.Discard, client)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 10))
+		errCh <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	common.Must(conn.Close())
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("expected error writing to a closed connection")
+		}
+	case <-time.After(time.Second):
+		t.Error("Write did not return after Close")
+	}
+}
+
+func TestCounterConnectionReadLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:  server,
+		ReadLimiter: rate.NewLimiter(100*1024, 10*1024),
+	}
+	defer conn.Close()
+
+	go client.Write(make([]byte, 60*1024))
+
+	start := time.Now()
+	b := make([]byte, 60*1024)
+	n, err := conn.Read(b)
+	common.Must(err)
+	if n > 10*1024 {
+		t.Error("read of ", n, " bytes exceeds the burst of ", 10*1024)
+	}
+	common.Must2(io.ReadFull(conn, b[n:]))
+	elapsed := time.Since(start)
+
+	// The first 10KiB are covered by the initial burst.
+	if elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Error("unexpected duration for 60KiB at 100KiB/s: ", elapsed)
+	}
+}
+
+func TestCounterConnectionReadLimitClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:  server,
+		ReadLimiter: rate.NewLimiter(1, 10),
+	}
+
+	go client.Write(make([]byte, 20))
+
+	// The first 10 bytes use up the burst.
+	common.Must2(io.ReadFull(conn, make([]byte, 10)))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		errCh <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	common.Must(conn.Close())
+
+	select {
+	case err := <-errCh:
+		if err != net.ErrClosed {
+			t.Error("expected net.ErrClosed from a Read waiting for the limiter, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Read did not return after Close")
+	}
+}
+
+func TestNewDirectionalCounter(t *testing.T) {
+	uplink := new(stats.Counter)
+	downlink := new(stats.Counter)
+
+	in := NewDirectionalCounter(nil, uplink, downlink, true)
+	if in.ReadCounter != uplink || in.WriteCounter != downlink {
+		t.Error("inbound connection should read uplink and write downlink")
+	}
+
+	out := NewDirectionalCounter(nil, uplink, downlink, false)
+	if out.ReadCounter != downlink || out.WriteCounter != uplink {
+		t.Error("outbound connection should read downlink and write uplink")
+	}
+}
+
+func TestCounterConnectionSwapAndReset(t *testing.T) {
+	shared := new(stats.Counter)
+	shared.Add(100)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &CounterConnection{
+		Connection:   server,
+		ReadCounter:  shared,
+		WriteCounter: new(stats.Counter),
+	}
+	defer conn.Close()
+
+	other, otherPeer := net.Pipe()
+	defer otherPeer.Close()
+	otherConn := &CounterConnection{
+		Connection:  other,
+		ReadCounter: shared,
+	}
+	defer otherConn.Close()
+
+	go func() {
+		common.Must2(client.Write(make([]byte, 7)))
+		common.Must2(io.ReadFull(client, make([]byte, 9)))
+		common.Must2(client.Write(make([]byte, 2)))
+		common.Must2(otherPeer.Write(make([]byte, 4)))
+	}()
+
+	common.Must2(io.ReadFull(conn, make([]byte, 7)))
+	common.Must2(conn.Write(make([]byte, 9)))
+	if r, w := conn.SwapAndReset(); r != 7 || w != 9 {
+		t.Error("unexpected SwapAndReset() return: ", r, w, ", wanted ", 7, 9)
+	}
+
+	common.Must2(io.ReadFull(conn, make([]byte, 2)))
+	common.Must2(io.ReadFull(otherConn, make([]byte, 4)))
+	if r, w := conn.SwapAndReset(); r != 2 || w != 0 {
+		t.Error("unexpected SwapAndReset() return: ", r, w, ", wanted ", 2, 0)
+	}
+	if r, w := conn.SwapAndReset(); r != 0 || w != 0 {
+		t.Error("interval not reset: ", r, w)
+	}
+	if r, _ := otherConn.SwapAndReset(); r != 4 {
+		t.Error("unexpected SwapAndReset() return of second connection: ", r, ", wanted ", 4)
+	}
+
+	if v := shared.Value(); v != 113 {
+		t.Error("shared counter changed by SwapAndReset: ", v, ", wanted ", 113)
+	}
+	if r, w := conn.ReadBytes(), conn.WriteBytes(); r != 9 || w != 9 {
+		t.Error("totals changed by SwapAndReset: ", r, w, ", wanted ", 9, 9)
+	}
+	if r, w := (&CounterConnection{}).SwapAndReset(); r != 0 || w != 0 {
+		t.Error("expected 0 without traffic")
+	}
+}
+
+func TestCounterConnectionReadIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:      server,
+		ReadIdleTimeout: 100 * time.Millisecond,
+	}
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			common.Must2(client.Write([]byte("a")))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	b := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Read(b); err != nil {
+			t.Fatal("read before idle timeout failed: ", err)
+		}
+	}
+
+	if _, err := conn.Read(b); err == nil || !err.(net.Error).Timeout() {
+		t.Error("expected timeout after idle period, got ", err)
+	}
+}
+
+func TestCounterConnectionReadIdleTimeoutSilentPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:      server,
+		ReadIdleTimeout: 50 * time.Millisecond,
+	}
+	defer conn.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Error("expected timeout from a peer that never sends, got ", err)
+	}
+}
+
+func TestCounterConnectionReadIdleTimeoutCallerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &CounterConnection{
+		Connection:      server,
+		ReadIdleTimeout: 50 * time.Millisecond,
+	}
+	defer conn.Close()
+
+	b := make([]byte, 1)
+	common.Must(conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond)))
+	start := time.Now()
+	if _, err := conn.Read(b); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal("expected timeout, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Error("caller deadline overridden by idle timeout after ", elapsed)
+	}
+
+	common.Must(conn.SetReadDeadline(time.Time{}))
+	start = time.Now()
+	if _, err := conn.Read(b); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal("expected idle timeout after clearing the deadline, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Error("idle timeout not restored, read took ", elapsed)
+	}
+}
+
+// closingConn is a connection that refuses new deadlines, like a KCP connection
+// that is no longer active, and reports io.EOF on Read.
+type closingConn struct {
+	net.Conn
+}
+
+func (closingConn) Read(b []byte) (int, error) { return 0, io.EOF }
+
+func (closingConn) SetReadDeadline(time.Time) error { return net.ErrClosed }
+
+func TestCounterConnectionReadIdleTimeoutDeadlineError(t *testing.T) {
+	conn := &CounterConnection{
+		Connection:      closingConn{},
+		ReadIdleTimeout: time.Second,
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("deadline error masked the Read result: ", err)
+	}
+}
+
+func TestCounterConnectionReadFromWriteTo(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	common.Must(err)
+	defer listener.Close()
+
+	data := make([]byte, 256*1024)
+	go func() {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		common.Must(err)
+		defer client.Close()
+		common.Must2(client.Write(data))
+		client.(*net.TCPConn).CloseWrite()
+		common.Must2(io.Copy(io.Discard, client))
+	}()
+
+	server, err := listener.Accept()
+	common.Must(err)
+
+	conn := &CounterConnection{
+		Connection:   server,
+		ReadCounter:  new(stats.Counter),
+		WriteCounter: new(stats.Counter),
+	}
+
+	if n, err := conn.WriteTo(io.Discard); err != nil || n != int64(len(data)) {
+		t.Error("unexpected WriteTo() return: ", n, err)
+	}
+	if n, err := conn.ReadFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Error("unexpected ReadFrom() return: ", n, err)
+	}
+	common.Must(conn.Close())
+
+	if v := conn.ReadBytes(); v != int64(len(data)) {
+		t.Error("unexpected ReadBytes() return: ", v, ", wanted ", len(data))
+	}
+	if v := conn.WriteBytes(); v != int64(len(data)) {
+		t.Error("unexpected WriteBytes() return: ", v, ", wanted ", len(data))
+	}
+}
+
+func TestTrafficCounters(t *testing.T) {
+	raw, err := common.CreateObject(context.Background(), &stats.Config{})
+	common.Must(err)
+	m := raw.(feature_stats.Manager)
+
+	all := policy.SystemStats{
+		InboundUplink:    true,
+		InboundDownlink:  true,
+		OutboundUplink:   true,
+		OutboundDownlink: true,
+	}
+
+	if u, d := TrafficCounters(nil, all, "in", true); u != nil || d != nil {
+		t.Error("expected nil counters without a manager")
+	}
+	if u, d := TrafficCounters(m, all, "", true); u != nil || d != nil {
+		t.Error("expected nil counters without a tag")
+	}
+	if u, d := TrafficCounters(m, policy.SystemStats{OutboundUplink: true}, "off", true); u != nil || d != nil {
+		t.Error("expected nil counters with inbound stats disabled")
+	}
+	if m.GetCounter("inbound>>>off>>>traffic>>>uplink") != nil {
+		t.Error("registered a counter disabled by policy")
+	}
+
+	if u, d := TrafficCounters(m, all, "in", true); u != m.GetCounter("inbound>>>in>>>traffic>>>uplink") ||
+		d != m.GetCounter("inbound>>>in>>>traffic>>>downlink") || u == nil || d == nil {
+		t.Error("unexpected inbound counters")
+	}
+
+	u, d := TrafficCounters(m, policy.SystemStats{OutboundUplink: true}, "out", false)
+	if d != nil || u == nil || u != m.GetCounter("outbound>>>out>>>traffic>>>uplink") {
+		t.Error("unexpected outbound counters")
+	}
+	if m.GetCounter("outbound>>>out>>>traffic>>>downlink") != nil {
+		t.Error("registered a counter disabled by policy")
+	}
+}
+
+func TestCounterConnectionCounterWrap(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var wrapped feature_stats.Counter
+	conn := &CounterConnection{
+		Connection:    server,
+		WriteCounter:  new(stats.Counter),
+		OnCounterWrap: func(c feature_stats.Counter) { wrapped = c },
+	}
+	defer conn.Close()
+
+	go io.Copy(io.Discard, client)
+
+	conn.WriteCounter.Set(math.MaxInt64 - 8)
+	common.Must2(conn.Write(make([]byte, 8)))
+	if wrapped != nil {
+		t.Fatal("OnCounterWrap fired without overflow")
+	}
+
+	common.Must2(conn.Write(make([]byte, 2)))
+	if wrapped != conn.WriteCounter {
+		t.Fatal("OnCounterWrap did not fire on overflow")
+	}
+	if v := conn.WriteCounter.Value(); v != math.MinInt64+1 {
+		t.Error("unexpected value after wrap: ", v, ", wanted ", int64(math.MinInt64+1))
+	}
+}
+
+func TestCounterConnectionOnIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var idle atomic.Int32
+	conn := &CounterConnection{
+		Connection: server,
+		OnIdle:     func() { idle.Add(1) },
+		IdleWindow: 50 * time.Millisecond,
+	}
+
+	go func() {
+		common.Must2(client.Write([]byte("a")))
+		time.Sleep(200 * time.Millisecond)
+		common.Must2(client.Write([]byte("b")))
+	}()
+
+	b := make([]byte, 1)
+	common.Must2(conn.Read(b))
+	common.Must2(conn.Read(b))
+	if v := idle.Load(); v != 1 {
+		t.Error("unexpected OnIdle calls during one idle period: ", v, ", wanted ", 1)
+	}
+
+	common.Must(conn.Close())
+	time.Sleep(100 * time.Millisecond)
+	if v := idle.Load(); v != 1 {
+		t.Error("OnIdle fired after Close")
+	}
+}
+
+// dataConn is a connection whose Read keeps returning data even after Close.
+type dataConn struct {
+	net.Conn
+}
+
+func (dataConn) Read(b []byte) (int, error) { return len(b), nil }
+
+func (dataConn) Close() error { return nil }
+
+func TestCounterConnectionOnIdleCloseThenRead(t *testing.T) {
+	conn := &CounterConnection{
+		Connection: dataConn{},
+		OnIdle:     func() {},
+		IdleWindow: time.Second,
+	}
+
+	common.Must(conn.Close())
+	if n, err := conn.Read(make([]byte, 4)); n != 4 || err != nil {
+		t.Error("unexpected Read() return after Close: ", n, err)
+	}
+}